@@ -0,0 +1,87 @@
+package libwebsocketd
+
+import (
+	"flag"
+	"strings"
+)
+
+// Config holds the configuration that drives a WebsocketdServer and the
+// WebsocketdHandlers it spawns from incoming requests.
+type Config struct {
+	// process launching
+	CommandName string
+	CommandArgs []string
+	Binary      bool
+	UnixSocket  bool
+	CloseMs     int
+
+	// FastCGI, when UnixSocket is also set, expects the spawned process
+	// to speak FastCGI on the session socket instead of a raw byte
+	// stream; see fastcgi.go.
+	FastCGI bool
+
+	// IdFormat selects the session id scheme: "uuid" (default), "ulid",
+	// or "nano" for the legacy nanosecond-timestamp format.
+	IdFormat string
+
+	// script-dir based dispatch
+	UsingScriptDir bool
+	ScriptDir      string
+
+	// remote info
+	RemoteHeader  string
+	ReverseLookup bool
+
+	// static and CGI passthrough, served alongside the websocket handler
+	StaticDir  string
+	StaticPath string
+	CgiDir     string
+	CgiPath    string
+
+	// RoutePrecedence is the order, by name ("static", "cgi", "ws"), in
+	// which ServeHTTP tries to match an incoming request. Empty means
+	// the default order below.
+	RoutePrecedence []string
+
+	// NegotiateSubprotocol opts a unix-socket deployment into delegating
+	// Sec-WebSocket-Protocol negotiation to the spawned process; see
+	// accept() in handler.go. Off by default, since existing
+	// unix-socket scripts weren't written expecting their first line of
+	// output to be read as a protocol choice.
+	NegotiateSubprotocol bool
+}
+
+// DefaultRoutePrecedence is used when Config.RoutePrecedence isn't set.
+var DefaultRoutePrecedence = []string{"static", "cgi", "ws"}
+
+// AddStaticAndCgiFlags registers the --staticdir/--staticpath,
+// --cgidir/--cgipath, and --routeprecedence flags onto fs, storing their
+// values directly into c.
+func (c *Config) AddStaticAndCgiFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.StaticDir, "staticdir", "", "Serve static content from this directory over HTTP")
+	fs.StringVar(&c.StaticPath, "staticpath", "/static/", "URL path prefix under which --staticdir is served")
+	fs.StringVar(&c.CgiDir, "cgidir", "", "Run CGI scripts from this directory over HTTP")
+	fs.StringVar(&c.CgiPath, "cgipath", "/cgi-bin/", "URL path prefix under which --cgidir is served")
+	fs.Func("routeprecedence", `Comma-separated match order for the static, cgi, and ws routes (default "static,cgi,ws")`, func(s string) error {
+		c.RoutePrecedence = strings.Split(s, ",")
+		return nil
+	})
+}
+
+// AddIdFormatFlag registers the --idformat flag onto fs, storing its
+// value directly into c.
+func (c *Config) AddIdFormatFlag(fs *flag.FlagSet) {
+	fs.StringVar(&c.IdFormat, "idformat", "uuid", "Session id format: uuid, ulid, or nano")
+}
+
+// AddFastCGIFlag registers the --fastcgi flag onto fs, storing its value
+// directly into c.
+func (c *Config) AddFastCGIFlag(fs *flag.FlagSet) {
+	fs.BoolVar(&c.FastCGI, "fastcgi", false, "Speak FastCGI, rather than a raw byte stream, over the unix socket")
+}
+
+// AddNegotiateSubprotocolFlag registers the --negotiatesubprotocol flag
+// onto fs, storing its value directly into c.
+func (c *Config) AddNegotiateSubprotocolFlag(fs *flag.FlagSet) {
+	fs.BoolVar(&c.NegotiateSubprotocol, "negotiatesubprotocol", false, "Let the unix-socket child process choose the WebSocket subprotocol")
+}
@@ -0,0 +1,199 @@
+package libwebsocketd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// This file implements just enough of the FastCGI 1.0 wire protocol to
+// bridge a WebSocket session onto a FastCGI responder listening on the
+// same per-session AF_UNIX socket handler.go already sets up: one
+// WebSocket message in, one FastCGI request/response round-trip, one
+// WebSocket message out. It intentionally does not implement the parts
+// of FastCGI (multiplexed requests, stdin streaming, filter role) that a
+// one-message-per-request bridge has no use for.
+
+const (
+	fcgiVersion1 = 1
+
+	fcgiBeginRequest = 1
+	fcgiParams       = 4
+	fcgiStdin        = 5
+	fcgiStdout       = 6
+	fcgiEndRequest   = 3
+	fcgiStderr       = 7
+
+	fcgiResponder = 1
+	fcgiKeepConn  = 1
+
+	// The bridge never has more than one FastCGI request in flight on a
+	// given socket, so a fixed request id is fine.
+	fcgiRequestId = 1
+)
+
+// serveFastCGI treats each inbound WebSocket text/binary message as the
+// stdin of one FastCGI request against the process listening on conn,
+// and relays the resulting stdout back as a WebSocket message. It runs
+// until the WebSocket connection closes or a protocol error occurs.
+func serveFastCGI(ws *websocket.Conn, conn *net.UnixConn, wsh *WebsocketdHandler, log *LogScope) {
+	for {
+		msgType, payload, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		reply, err := fcgiRoundTrip(conn, wsh.Env, payload, log)
+		if err != nil {
+			log.Error("fastcgi", "request failed: %s", err)
+			return
+		}
+
+		if err := ws.WriteMessage(msgType, reply); err != nil {
+			log.Error("fastcgi", "could not write websocket reply: %s", err)
+			return
+		}
+	}
+}
+
+// fcgiRoundTrip performs one FastCGI BEGIN_REQUEST/PARAMS/STDIN exchange
+// over rw and returns the concatenated STDOUT records of the response.
+// It takes io.ReadWriter rather than *net.UnixConn so the framer can be
+// exercised against a fake responder in tests.
+func fcgiRoundTrip(rw io.ReadWriter, env []string, stdin []byte, log *LogScope) ([]byte, error) {
+	if err := fcgiWriteBeginRequest(rw); err != nil {
+		return nil, err
+	}
+	if err := fcgiWriteParams(rw, env); err != nil {
+		return nil, err
+	}
+	if err := fcgiWriteStream(rw, fcgiStdin, stdin); err != nil {
+		return nil, err
+	}
+
+	return fcgiReadResponse(rw, log)
+}
+
+func fcgiWriteBeginRequest(w io.Writer) error {
+	body := make([]byte, 8)
+	binary.BigEndian.PutUint16(body[0:2], fcgiResponder)
+	// FCGI_KEEP_CONN must be set: the same AF_UNIX connection carries
+	// every FastCGI round trip for the lifetime of the WebSocket
+	// session, not just one request.
+	body[2] = fcgiKeepConn
+	return fcgiWriteRecord(w, fcgiBeginRequest, body)
+}
+
+// fcgiWriteParams encodes env ("KEY=VALUE" strings, as produced by
+// createEnv) into FastCGI name-value pairs and writes them as a single
+// PARAMS stream, terminated by the required empty record.
+func fcgiWriteParams(w io.Writer, env []string) error {
+	var body []byte
+	for _, kv := range env {
+		key, value, found := strings.Cut(kv, "=")
+		if !found {
+			continue
+		}
+		body = fcgiAppendNameValue(body, key, value)
+	}
+	return fcgiWriteStream(w, fcgiParams, body)
+}
+
+func fcgiAppendNameValue(body []byte, name, value string) []byte {
+	body = fcgiAppendLength(body, len(name))
+	body = fcgiAppendLength(body, len(value))
+	body = append(body, name...)
+	body = append(body, value...)
+	return body
+}
+
+func fcgiAppendLength(body []byte, n int) []byte {
+	if n < 128 {
+		return append(body, byte(n))
+	}
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(n)|1<<31)
+	return append(body, length...)
+}
+
+// fcgiWriteStream writes content as a series of records of the given
+// type, followed by the empty record that terminates a FastCGI stream.
+func fcgiWriteStream(w io.Writer, kind uint8, content []byte) error {
+	for len(content) > 0 {
+		chunk := content
+		if len(chunk) > 0xffff {
+			chunk = chunk[:0xffff]
+		}
+		if err := fcgiWriteRecord(w, kind, chunk); err != nil {
+			return err
+		}
+		content = content[len(chunk):]
+	}
+	return fcgiWriteRecord(w, kind, nil)
+}
+
+func fcgiWriteRecord(w io.Writer, kind uint8, content []byte) error {
+	header := make([]byte, 8)
+	header[0] = fcgiVersion1
+	header[1] = kind
+	binary.BigEndian.PutUint16(header[2:4], fcgiRequestId)
+	binary.BigEndian.PutUint16(header[4:6], uint16(len(content)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if len(content) > 0 {
+		if _, err := w.Write(content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fcgiReadResponse reads STDOUT records until END_REQUEST and returns
+// their concatenated content. FCGI_STDERR records are logged rather than
+// treated as a protocol error: real FastCGI responders (PHP-FPM, Python's
+// flup, ...) routinely emit diagnostics there alongside a perfectly good
+// STDOUT response.
+func fcgiReadResponse(r io.Reader, log *LogScope) ([]byte, error) {
+	var stdout []byte
+	header := make([]byte, 8)
+
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return nil, err
+		}
+
+		kind := header[1]
+		length := binary.BigEndian.Uint16(header[4:6])
+		padding := header[6]
+
+		content := make([]byte, length)
+		if length > 0 {
+			if _, err := io.ReadFull(r, content); err != nil {
+				return nil, err
+			}
+		}
+		if padding > 0 {
+			if _, err := io.CopyN(io.Discard, r, int64(padding)); err != nil {
+				return nil, err
+			}
+		}
+
+		switch kind {
+		case fcgiStdout:
+			stdout = append(stdout, content...)
+		case fcgiStderr:
+			if len(content) > 0 {
+				log.Error("fastcgi", "stderr: %s", content)
+			}
+		case fcgiEndRequest:
+			return stdout, nil
+		default:
+			return nil, fmt.Errorf("unexpected FastCGI record type %d", kind)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package libwebsocketd
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+// fakeFastCGIResponder plays the server side of the FastCGI protocol
+// well enough to drive fcgiRoundTrip: it reads BEGIN_REQUEST, drains the
+// PARAMS and STDIN streams, and replies with a canned STDOUT record
+// followed by END_REQUEST. Per the FastCGI spec, it closes conn after
+// responding unless the request's FCGI_KEEP_CONN bit was set - this is
+// what makes the test catch a framer that forgets to set it.
+func fakeFastCGIResponder(t *testing.T, conn net.Conn, reply []byte) {
+	t.Helper()
+
+	for {
+		header := make([]byte, 8)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		if header[1] != fcgiBeginRequest {
+			t.Errorf("fake responder: expected BEGIN_REQUEST, got record type %d", header[1])
+			return
+		}
+
+		body := make([]byte, binary.BigEndian.Uint16(header[4:6]))
+		if _, err := io.ReadFull(conn, body); err != nil {
+			t.Errorf("fake responder: reading BEGIN_REQUEST body: %s", err)
+			return
+		}
+		keepConn := len(body) > 2 && body[2]&fcgiKeepConn != 0
+
+		if err := fakeDrainStream(conn); err != nil { // PARAMS
+			t.Errorf("fake responder: draining PARAMS: %s", err)
+			return
+		}
+		if err := fakeDrainStream(conn); err != nil { // STDIN
+			t.Errorf("fake responder: draining STDIN: %s", err)
+			return
+		}
+
+		if err := fcgiWriteRecord(conn, fcgiStdout, reply); err != nil {
+			t.Errorf("fake responder: writing STDOUT: %s", err)
+			return
+		}
+		if err := fcgiWriteRecord(conn, fcgiStdout, nil); err != nil {
+			t.Errorf("fake responder: writing STDOUT terminator: %s", err)
+			return
+		}
+		if err := fcgiWriteRecord(conn, fcgiEndRequest, make([]byte, 8)); err != nil {
+			t.Errorf("fake responder: writing END_REQUEST: %s", err)
+			return
+		}
+
+		if !keepConn {
+			conn.Close()
+			return
+		}
+	}
+}
+
+// fakeDrainStream reads FastCGI stream records (PARAMS or STDIN) until
+// the terminating empty record.
+func fakeDrainStream(conn net.Conn) error {
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return err
+		}
+		length := binary.BigEndian.Uint16(header[4:6])
+		if length == 0 {
+			return nil
+		}
+		if _, err := io.CopyN(io.Discard, conn, int64(length)); err != nil {
+			return err
+		}
+	}
+}
+
+// TestFcgiRoundTripReusesConnection exercises two FastCGI round trips
+// over the same connection, as serveFastCGI does for a multi-message
+// WebSocket session. It fails if BEGIN_REQUEST doesn't set
+// FCGI_KEEP_CONN, since the fake responder (like any spec-compliant
+// FastCGI responder) closes the connection after one request otherwise.
+func TestFcgiRoundTripReusesConnection(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	// A single responder goroutine services both round trips on the same
+	// connection, exactly as a real FastCGI daemon with FCGI_KEEP_CONN
+	// honored would.
+	go fakeFastCGIResponder(t, server, []byte("pong"))
+
+	// The fake responder above never emits FCGI_STDERR, so fcgiRoundTrip
+	// never dereferences log; passing nil keeps this test from depending
+	// on LogScope's (unrelated) construction details.
+	reply, err := fcgiRoundTrip(client, []string{"REQUEST_METHOD=GET"}, []byte("first"), nil)
+	if err != nil {
+		t.Fatalf("first round trip failed: %s", err)
+	}
+	if string(reply) != "pong" {
+		t.Fatalf("first round trip reply = %q, want %q", reply, "pong")
+	}
+
+	reply, err = fcgiRoundTrip(client, []string{"REQUEST_METHOD=GET"}, []byte("second"), nil)
+	if err != nil {
+		t.Fatalf("second round trip failed (connection likely closed by responder): %s", err)
+	}
+	if string(reply) != "pong" {
+		t.Fatalf("second round trip reply = %q, want %q", reply, "pong")
+	}
+}
@@ -8,13 +8,31 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
 	"time"
-
-	"github.com/gorilla/websocket"
 )
 
+// WebsocketdUnixSocketEnv is the name of the environment variable carrying
+// the path of the per-session AF_UNIX socket the child process should
+// connect back to.
+const WebsocketdUnixSocketEnv = "WEBSOCKETD_UNIX_SOCKET"
+
+// WebsocketdIdEnv is the name of the environment variable carrying the
+// session id assigned to this connection.
+const WebsocketdIdEnv = "WEBSOCKETD_ID"
+
+// WebsocketdSubprotocolsEnv is the name of the environment variable
+// carrying the comma-separated, client-preference-ordered list of
+// WebSocket subprotocols offered in the handshake.
+const WebsocketdSubprotocolsEnv = "WEBSOCKETD_SUBPROTOCOLS"
+
+// subprotocolTimeout bounds how long accept() waits for a unix-socket
+// child to report its chosen subprotocol before giving up on
+// negotiation and upgrading with none.
+const subprotocolTimeout = 2 * time.Second
+
 var ScriptNotFoundError = errors.New("script not found")
 
 // WebsocketdHandler is a single request information and processing structure, it handles WS requests out of all that daemon can handle (static, cgi, devconsole)
@@ -31,7 +49,7 @@ type WebsocketdHandler struct {
 
 // NewWebsocketdHandler constructs the struct and parses all required things in it...
 func NewWebsocketdHandler(s *WebsocketdServer, req *http.Request, log *LogScope) (wsh *WebsocketdHandler, err error) {
-	wsh = &WebsocketdHandler{server: s, Id: generateId()}
+	wsh = &WebsocketdHandler{server: s, Id: generateId(s.Config.IdFormat)}
 	log.Associate("id", wsh.Id)
 
 	wsh.RemoteInfo, err = GetRemoteInfo(req, s.Config)
@@ -53,32 +71,50 @@ func NewWebsocketdHandler(s *WebsocketdServer, req *http.Request, log *LogScope)
 	}
 	log.Associate("command", wsh.command)
 
-	wsh.Env = createEnv(wsh, req, log)
+	wsh.Env = append(createEnv(wsh, req, log), WebsocketdIdEnv+"="+wsh.Id)
 
 	return wsh, nil
 }
 
-func (wsh *WebsocketdHandler) accept(ws *websocket.Conn, log *LogScope) {
-	defer ws.Close()
+// accept starts the child process, upgrades the HTTP connection to a
+// WebSocket, and pipes the two together. The upgrade happens here rather
+// than before accept() is called because, in unix-socket mode, the
+// subprotocol the response reports back to the client is whatever the
+// child process picks — which isn't known until after it's running.
+func (wsh *WebsocketdHandler) accept(w http.ResponseWriter, req *http.Request, log *LogScope) {
+	binary := wsh.server.Config.Binary
 
-	log.Access("session", "CONNECT")
-	defer log.Access("session", "DISCONNECT")
+	if wsh.server.Config.UnixSocket {
+		listener, sockPath, cleanupSock, err := newSessionUnixListener(wsh.Id)
+		if err != nil {
+			log.Error("process", "Could not create unix socket for session %s: %s", wsh.Id, err)
+			http.Error(w, "could not start session", http.StatusInternalServerError)
+			return
+		}
+		defer listener.Close()
+		defer cleanupSock()
 
-	binary := wsh.server.Config.Binary
+		var offeredSubprotocols string
+		if wsh.server.Config.NegotiateSubprotocol {
+			offeredSubprotocols = req.Header.Get("Sec-WebSocket-Protocol")
+		}
 
-	wsEndpoint := NewWebSocketEndpoint(ws, binary, log)
+		env := wsh.Env
+		if offeredSubprotocols != "" {
+			env = append(env, WebsocketdSubprotocolsEnv+"="+offeredSubprotocols)
+		}
 
-	if wsh.server.Config.UnixSocket {
 		cmd := exec.Command(wsh.command, wsh.server.Config.CommandArgs...)
-		cmd.Env = wsh.Env
+		cmd.Env = append(env, WebsocketdUnixSocketEnv+"="+sockPath)
 
 		if err := cmd.Start(); err != nil {
 			log.Error("process", "Could not launch process %s %s (%s)", wsh.command, strings.Join(wsh.server.Config.CommandArgs, " "), err)
+			http.Error(w, "could not start session", http.StatusInternalServerError)
 			return
 		}
 
-		wsh.server.unixSocketListener.SetDeadline(time.Now().Add(10*time.Second))
-		conn, err := wsh.server.unixSocketListener.AcceptUnix()
+		listener.SetDeadline(time.Now().Add(10 * time.Second))
+		conn, err := listener.AcceptUnix()
 
 		if err != nil {
 			log.Error("process", "accept error: %s", err)
@@ -87,6 +123,35 @@ func (wsh *WebsocketdHandler) accept(ws *websocket.Conn, log *LogScope) {
 
 		log.Associate("pid", strconv.Itoa(cmd.Process.Pid))
 
+		// Only wait for a subprotocol line if the client actually
+		// offered one - otherwise a script's normal output could
+		// contain a newline and be silently consumed here instead of
+		// piped to the client, and scripts that never emit a newline
+		// would pay a pointless timeout on every request.
+		var responseHeader http.Header
+		if offeredSubprotocols != "" {
+			if subprotocol := readSubprotocolLine(conn, subprotocolTimeout); subprotocol != "" {
+				responseHeader = http.Header{}
+				responseHeader.Set("Sec-WebSocket-Protocol", subprotocol)
+			}
+		}
+
+		ws, err := wsh.server.upgrader.Upgrade(w, req, responseHeader)
+		if err != nil {
+			log.Error("session", "Could not upgrade websocket connection: %s", err)
+			return
+		}
+		defer ws.Close()
+
+		log.Access("session", "CONNECT")
+		defer log.Access("session", "DISCONNECT")
+
+		if wsh.server.Config.FastCGI {
+			serveFastCGI(ws, conn, wsh, log)
+			return
+		}
+
+		wsEndpoint := NewWebSocketEndpoint(ws, binary, log)
 		procEndpoint := NewDomainEndpoint(cmd, conn, log)
 
 		if cms := wsh.server.Config.CloseMs; cms != 0 {
@@ -95,6 +160,22 @@ func (wsh *WebsocketdHandler) accept(ws *websocket.Conn, log *LogScope) {
 
 		PipeEndpoints(procEndpoint, wsEndpoint)
 	} else {
+		// Subprotocol negotiation is currently only wired up for
+		// unix-socket sessions; the stdio pipe used here has no
+		// equivalent side channel for the child to report a choice on
+		// ahead of the upgrade.
+		ws, err := wsh.server.upgrader.Upgrade(w, req, nil)
+		if err != nil {
+			log.Error("session", "Could not upgrade websocket connection: %s", err)
+			return
+		}
+		defer ws.Close()
+
+		log.Access("session", "CONNECT")
+		defer log.Access("session", "DISCONNECT")
+
+		wsEndpoint := NewWebSocketEndpoint(ws, binary, log)
+
 		launched, err := launchCmd(wsh.command, wsh.server.Config.CommandArgs, wsh.Env)
 		if err != nil {
 			log.Error("process", "Could not launch process %s %s (%s)", wsh.command, strings.Join(wsh.server.Config.CommandArgs, " "), err)
@@ -113,6 +194,34 @@ func (wsh *WebsocketdHandler) accept(ws *websocket.Conn, log *LogScope) {
 	}
 }
 
+// readSubprotocolLine reads a single '\n'-terminated line off conn,
+// byte-by-byte so that no data past the newline is consumed from the
+// stream the caller still needs for the actual session traffic. It
+// returns the empty string, rather than an error, if the deadline
+// expires or the child sends nothing — callers fall back to upgrading
+// with no subprotocol in that case.
+func readSubprotocolLine(conn *net.UnixConn, timeout time.Duration) string {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	var line []byte
+	buf := make([]byte, 1)
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			if buf[0] == '\n' {
+				break
+			}
+			line = append(line, buf[0])
+		}
+		if err != nil {
+			return ""
+		}
+	}
+
+	return strings.TrimRight(string(line), "\r")
+}
+
 // RemoteInfo holds information about remote http client
 type RemoteInfo struct {
 	Addr, Host, Port string
@@ -193,6 +302,67 @@ func GetURLInfo(path string, config *Config) (*URLInfo, error) {
 	panic(fmt.Sprintf("GetURLInfo cannot parse path %#v", path))
 }
 
-func generateId() string {
-	return strconv.FormatInt(time.Now().UnixNano(), 10)
+// newSessionUnixListener creates and starts listening on a fresh,
+// session-scoped AF_UNIX socket so that concurrent sessions never race on
+// who gets to Accept() a given child's connection. The returned path is
+// the one to hand to the child (e.g. via an environment variable); the
+// caller must call the returned cleanup func once the session is done
+// with the socket.
+//
+// On Linux this uses the abstract socket namespace (a "@"-prefixed name,
+// per net.UnixAddr's convention), which isn't visible in the filesystem
+// at all, so there's no window between creating the path and the
+// legitimate child connecting to it for another local user to race.
+// Elsewhere it falls back to a file-backed socket inside a fresh,
+// 0700 directory so the same race can't be won by another user either.
+func newSessionUnixListener(id string) (listener *net.UnixListener, path string, cleanup func(), err error) {
+	if runtime.GOOS == "linux" {
+		return newAbstractSessionUnixListener(id)
+	}
+	return newFileSessionUnixListener(id)
+}
+
+func newAbstractSessionUnixListener(id string) (*net.UnixListener, string, func(), error) {
+	name := "@wsd-" + id
+
+	addr, err := net.ResolveUnixAddr("unix", name)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	listener, err := net.ListenUnix("unix", addr)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	return listener, name, func() {}, nil
+}
+
+func newFileSessionUnixListener(id string) (*net.UnixListener, string, func(), error) {
+	dir, err := os.MkdirTemp("", "wsd-")
+	if err != nil {
+		return nil, "", nil, err
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+
+	if err := os.Chmod(dir, 0700); err != nil {
+		cleanup()
+		return nil, "", nil, err
+	}
+
+	path := filepath.Join(dir, id+".sock")
+
+	addr, err := net.ResolveUnixAddr("unix", path)
+	if err != nil {
+		cleanup()
+		return nil, "", nil, err
+	}
+
+	listener, err := net.ListenUnix("unix", addr)
+	if err != nil {
+		cleanup()
+		return nil, "", nil, err
+	}
+
+	return listener, path, cleanup, nil
 }
@@ -0,0 +1,177 @@
+package libwebsocketd
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// TestNewSessionUnixListenerNoCrossTalk spins up many concurrent
+// session listeners (as accept() does per-WebSocket-connection) and
+// verifies that each one only ever receives the connection meant for it,
+// even under concurrent Accept()/dial pressure.
+func TestNewSessionUnixListenerNoCrossTalk(t *testing.T) {
+	const sessions = 64
+
+	var wg sync.WaitGroup
+	errs := make(chan error, sessions)
+
+	for i := 0; i < sessions; i++ {
+		id := fmt.Sprintf("%d-%d", time.Now().UnixNano(), i)
+
+		listener, path, cleanup, err := newSessionUnixListener(id)
+		if err != nil {
+			t.Fatalf("newSessionUnixListener(%q) failed: %s", id, err)
+		}
+		defer cleanup()
+
+		wg.Add(1)
+		go func(listener *net.UnixListener, path, want string) {
+			defer wg.Done()
+			defer listener.Close()
+			defer func() { _ = path }()
+
+			listener.SetDeadline(time.Now().Add(5 * time.Second))
+			conn, err := listener.AcceptUnix()
+			if err != nil {
+				errs <- fmt.Errorf("session %s: accept error: %s", want, err)
+				return
+			}
+			defer conn.Close()
+
+			buf := make([]byte, len(want))
+			if _, err := conn.Read(buf); err != nil {
+				errs <- fmt.Errorf("session %s: read error: %s", want, err)
+				return
+			}
+
+			if got := string(buf); got != want {
+				errs <- fmt.Errorf("cross-talk: session %s received payload %q", want, got)
+			}
+		}(listener, path, id)
+
+		// Dial as the child process would, writing its own id so any
+		// mix-up between listeners is immediately observable.
+		go func(path, id string) {
+			conn, err := net.Dial("unix", path)
+			if err != nil {
+				errs <- fmt.Errorf("session %s: dial error: %s", id, err)
+				return
+			}
+			defer conn.Close()
+			conn.Write([]byte(id))
+		}(path, id)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// unixConnPair dials a fresh session listener and returns the server
+// and client sides of the resulting connection.
+func unixConnPair(t *testing.T) (server *net.UnixConn, client net.Conn) {
+	t.Helper()
+
+	id := fmt.Sprintf("subproto-%d", time.Now().UnixNano())
+	listener, path, cleanup, err := newSessionUnixListener(id)
+	if err != nil {
+		t.Fatalf("newSessionUnixListener failed: %s", err)
+	}
+	t.Cleanup(cleanup)
+	defer listener.Close()
+
+	accepted := make(chan *net.UnixConn, 1)
+	go func() {
+		listener.SetDeadline(time.Now().Add(5 * time.Second))
+		conn, err := listener.AcceptUnix()
+		if err != nil {
+			t.Errorf("accept error: %s", err)
+		}
+		accepted <- conn
+	}()
+
+	client, err = net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("dial error: %s", err)
+	}
+
+	server = <-accepted
+	return server, client
+}
+
+func TestReadSubprotocolLineHappyPath(t *testing.T) {
+	server, client := unixConnPair(t)
+	defer server.Close()
+	defer client.Close()
+
+	client.Write([]byte("json-rpc\n"))
+
+	got := readSubprotocolLine(server, subprotocolTimeout)
+	if got != "json-rpc" {
+		t.Errorf("readSubprotocolLine() = %q, want %q", got, "json-rpc")
+	}
+}
+
+func TestReadSubprotocolLineTimeout(t *testing.T) {
+	server, client := unixConnPair(t)
+	defer server.Close()
+	defer client.Close()
+
+	// The child never writes a chosen subprotocol; negotiation should
+	// fall back to none rather than hang.
+	got := readSubprotocolLine(server, 100*time.Millisecond)
+	if got != "" {
+		t.Errorf("readSubprotocolLine() = %q, want empty string on timeout", got)
+	}
+}
+
+// TestUpgradeReportsNegotiatedSubprotocol drives an actual HTTP upgrade
+// and inspects the response gorilla/websocket produces, the way accept()
+// builds responseHeader for a unix-socket session. http.Header.Get
+// canonicalizes the key it looks up but not keys already in the map, so
+// a header built with a non-canonical literal key is invisible to
+// gorilla's own responseHeader.Get lookup even though it looks correct
+// at a glance — this test would have caught that.
+func TestUpgradeReportsNegotiatedSubprotocol(t *testing.T) {
+	upgrader := &websocket.Upgrader{CheckOrigin: func(*http.Request) bool { return true }}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		responseHeader := http.Header{}
+		responseHeader.Set("Sec-WebSocket-Protocol", "json-rpc")
+
+		ws, err := upgrader.Upgrade(w, r, responseHeader)
+		if err != nil {
+			t.Errorf("upgrade failed: %s", err)
+			return
+		}
+		defer ws.Close()
+	}))
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+	dialer := websocket.Dialer{Subprotocols: []string{"json-rpc", "other"}}
+
+	conn, resp, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dial failed: %s", err)
+	}
+	defer conn.Close()
+
+	if got := resp.Header.Get("Sec-WebSocket-Protocol"); got != "json-rpc" {
+		t.Errorf("response Sec-WebSocket-Protocol header = %q, want %q", got, "json-rpc")
+	}
+	if got := conn.Subprotocol(); got != "json-rpc" {
+		t.Errorf("negotiated subprotocol = %q, want %q", got, "json-rpc")
+	}
+}
@@ -0,0 +1,65 @@
+package libwebsocketd
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// generateId returns a session identifier in the given format. "nano"
+// reproduces the legacy nanosecond-timestamp identifier, kept around for
+// operators whose log tooling still parses it; "ulid" produces a
+// time-sortable identifier; anything else, including the empty string,
+// defaults to a random UUIDv4. Unlike the nanosecond timestamp, both
+// alternatives are collision-resistant under bursts of concurrent
+// connections.
+func generateId(format string) string {
+	switch format {
+	case "nano":
+		return strconv.FormatInt(time.Now().UnixNano(), 10)
+	case "ulid":
+		return generateUlid()
+	default:
+		return generateUuid4()
+	}
+}
+
+// generateUuid4 returns a random RFC 4122 version 4 UUID. It falls back
+// to the legacy nanosecond timestamp in the vanishingly unlikely case
+// that crypto/rand is unavailable, rather than handing back an empty id.
+func generateUuid4() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 10)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40 // version 4
+	b[8] = (b[8] & 0x3f) | 0x80 // variant 10
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// ulidEncoding is the Crockford base32 alphabet the ULID spec uses.
+var ulidEncoding = base32.NewEncoding("0123456789ABCDEFGHJKMNPQRSTVWXYZ").WithPadding(base32.NoPadding)
+
+// generateUlid returns a ULID: a 48-bit millisecond timestamp followed
+// by 80 bits of crypto/rand randomness, Crockford base32 encoded, so
+// that ids sort by creation time while remaining collision-resistant.
+func generateUlid() string {
+	var b [16]byte
+
+	ms := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	b[0] = byte(ms >> 40)
+	b[1] = byte(ms >> 32)
+	b[2] = byte(ms >> 24)
+	b[3] = byte(ms >> 16)
+	b[4] = byte(ms >> 8)
+	b[5] = byte(ms)
+
+	if _, err := rand.Read(b[6:]); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 10)
+	}
+
+	return ulidEncoding.EncodeToString(b[:])
+}
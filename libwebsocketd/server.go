@@ -0,0 +1,152 @@
+package libwebsocketd
+
+import (
+	"net/http"
+	"net/http/cgi"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebsocketdServer presents http.Handler interface for the requests
+// libwebsocketd knows how to handle: the websocket-backed process
+// handler, plus a static file tree and a CGI tree served alongside it.
+type WebsocketdServer struct {
+	Config   *Config
+	Log      *LogScope
+	upgrader *websocket.Upgrader
+}
+
+// NewWebsocketdServer creates a WebsocketdServer struct with sane defaults.
+func NewWebsocketdServer(config *Config, log *LogScope) *WebsocketdServer {
+	return &WebsocketdServer{
+		Config: config,
+		Log:    log,
+		upgrader: &websocket.Upgrader{
+			ReadBufferSize:  4096,
+			WriteBufferSize: 4096,
+			CheckOrigin:     func(*http.Request) bool { return true },
+		},
+	}
+}
+
+// ServeHTTP dispatches an incoming request to the static file tree, the
+// CGI tree, or the websocket process handler, trying each in the order
+// given by Config.RoutePrecedence (DefaultRoutePrecedence if unset) so
+// that, for example, a --cgidir tree can be given precedence over
+// --staticdir instead of being shadowed by it.
+func (h *WebsocketdServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	for _, route := range h.routePrecedence() {
+		switch route {
+		case "static":
+			if h.Config.StaticDir != "" && underPath(req.URL.Path, h.Config.StaticPath) {
+				h.serveStatic(w, req)
+				return
+			}
+		case "cgi":
+			if h.Config.CgiDir != "" && underPath(req.URL.Path, h.Config.CgiPath) {
+				h.serveCgi(w, req)
+				return
+			}
+		case "ws":
+			h.serveWebsocket(w, req)
+			return
+		}
+	}
+
+	http.NotFound(w, req)
+}
+
+func (h *WebsocketdServer) routePrecedence() []string {
+	if len(h.Config.RoutePrecedence) == 0 {
+		return DefaultRoutePrecedence
+	}
+	return h.Config.RoutePrecedence
+}
+
+func (h *WebsocketdServer) serveStatic(w http.ResponseWriter, req *http.Request) {
+	fileServer := http.FileServer(http.Dir(h.Config.StaticDir))
+	http.StripPrefix(h.Config.StaticPath, fileServer).ServeHTTP(w, req)
+}
+
+func (h *WebsocketdServer) serveCgi(w http.ResponseWriter, req *http.Request) {
+	log := h.Log.NewLogScope()
+
+	remoteInfo, err := GetRemoteInfo(req, h.Config)
+	if err != nil {
+		log.Error("session", "Could not understand remote address '%s': %s", req.RemoteAddr, err)
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	rel := strings.TrimPrefix(req.URL.Path, h.Config.CgiPath)
+
+	// path.Clean on a rooted path collapses any ".." segments down to
+	// "/" instead of letting them escape above it — the same defense
+	// http.Dir.Open relies on to keep static serving safe; cgi.Handler
+	// has no equivalent built in, so it's done here before the script
+	// path is ever handed to it.
+	scriptPath := filepath.Join(h.Config.CgiDir, filepath.FromSlash(path.Clean("/"+rel)))
+	if !isUnderDir(scriptPath, h.Config.CgiDir) {
+		http.NotFound(w, req)
+		return
+	}
+
+	wsh := &WebsocketdHandler{
+		server:     h,
+		Id:         generateId(h.Config.IdFormat),
+		RemoteInfo: remoteInfo,
+		URLInfo:    &URLInfo{ScriptPath: h.Config.CgiPath, FilePath: scriptPath},
+		command:    scriptPath,
+	}
+	log.Associate("id", wsh.Id)
+	log.Associate("remote", wsh.RemoteInfo.Host)
+	log.Associate("command", wsh.command)
+
+	handler := &cgi.Handler{
+		Path: scriptPath,
+		Root: h.Config.CgiPath,
+		Dir:  h.Config.CgiDir,
+		// Give CGI scripts the same per-request environment (remote
+		// info, session id, ...) that spawned websocket handlers get,
+		// rather than a hand-maintained list disconnected from it.
+		Env: createEnv(wsh, req, log),
+	}
+
+	handler.ServeHTTP(w, req)
+}
+
+// isUnderDir reports whether p is dir itself or lies within it, once
+// both are cleaned. Kept as a defense-in-depth check alongside the
+// path.Clean in serveCgi.
+func isUnderDir(p, dir string) bool {
+	dir = filepath.Clean(dir)
+	p = filepath.Clean(p)
+	return p == dir || strings.HasPrefix(p, dir+string(filepath.Separator))
+}
+
+func (h *WebsocketdServer) serveWebsocket(w http.ResponseWriter, req *http.Request) {
+	log := h.Log.NewLogScope()
+
+	wsh, err := NewWebsocketdHandler(h, req, log)
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+
+	// wsh.accept performs the upgrade itself: in unix-socket mode it
+	// needs the child running first to learn the subprotocol it should
+	// report back in the handshake response.
+	wsh.accept(w, req, log)
+}
+
+// underPath reports whether urlPath falls under the URL prefix
+// established by --staticpath / --cgipath.
+func underPath(urlPath, prefix string) bool {
+	if prefix == "" || prefix == "/" {
+		return true
+	}
+	return urlPath == strings.TrimSuffix(prefix, "/") || strings.HasPrefix(urlPath, prefix)
+}